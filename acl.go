@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// ACLConfig describes the allow/deny lists for a single rule: source IPs
+// (CIDR), destination host:port globs, and an optional per-user allow-list
+// that only applies once username/password auth is enabled on the rule.
+type ACLConfig struct {
+	AllowSrcCIDR []string `json:"allowSrcCIDR,omitempty"`
+	DenySrcCIDR  []string `json:"denySrcCIDR,omitempty"`
+	AllowDest    []string `json:"allowDest,omitempty"` // host/port通配符，例如 "*.internal:*"
+	DenyDest     []string `json:"denyDest,omitempty"`
+	AllowUsers   []string `json:"allowUsers,omitempty"`
+}
+
+// aclRuleSet 是socks5.RuleSet的实现，先按commands过滤支持的SOCKS5命令
+// （CONNECT/BIND/ASSOCIATE），再按ACLConfig中配置的允许/拒绝列表做一次过滤。
+type aclRuleSet struct {
+	commands socks5.PermitCommand
+	acl      ACLConfig
+}
+
+// newACLRuleSet 根据规则允许的命令与ACL配置构造一个socks5.RuleSet；ACL为空时
+// 只做命令过滤，等价于原本的socks5.PermitCommand。
+func newACLRuleSet(commands socks5.PermitCommand, acl ACLConfig) socks5.RuleSet {
+	return &aclRuleSet{commands: commands, acl: acl}
+}
+
+// Allow implement interface socks5.RuleSet
+func (r *aclRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if ctx, ok := r.commands.Allow(ctx, req); !ok {
+		return ctx, false
+	}
+
+	if !aclAllowsSrc(r.acl, req.RemoteAddr) {
+		return ctx, false
+	}
+
+	if !aclAllowsDest(r.acl, req.DestAddr) {
+		return ctx, false
+	}
+
+	if len(r.acl.AllowUsers) > 0 {
+		username := ""
+		if req.AuthContext != nil {
+			username = req.AuthContext.Payload["username"]
+		}
+		if !containsString(r.acl.AllowUsers, username) {
+			return ctx, false
+		}
+	}
+
+	return ctx, true
+}
+
+func aclAllowsSrc(acl ACLConfig, addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+
+	for _, cidr := range acl.DenySrcCIDR {
+		if cidrContains(cidr, ip) {
+			return false
+		}
+	}
+
+	if len(acl.AllowSrcCIDR) == 0 {
+		return true
+	}
+	for _, cidr := range acl.AllowSrcCIDR {
+		if cidrContains(cidr, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func aclAllowsDest(acl ACLConfig, dest *statute.AddrSpec) bool {
+	if dest == nil {
+		return true
+	}
+	target := dest.String()
+
+	for _, glob := range acl.DenyDest {
+		if destGlobMatch(glob, target) {
+			return false
+		}
+	}
+
+	if len(acl.AllowDest) == 0 {
+		return true
+	}
+	for _, glob := range acl.AllowDest {
+		if destGlobMatch(glob, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// destGlobMatch 用path.Match分别匹配host和port两段通配符，例如 "*.internal:443"。
+func destGlobMatch(glob, target string) bool {
+	globHost, globPort, err1 := net.SplitHostPort(glob)
+	targetHost, targetPort, err2 := net.SplitHostPort(target)
+	if err1 != nil || err2 != nil {
+		ok, _ := path.Match(glob, target)
+		return ok
+	}
+
+	hostOK, _ := path.Match(globHost, targetHost)
+	portOK, _ := path.Match(globPort, targetPort)
+	return hostOK && portOK
+}
+
+func cidrContains(cidr string, ip net.IP) bool {
+	if !strings.Contains(cidr, "/") {
+		return net.ParseIP(cidr).Equal(ip)
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	return ipNet.Contains(ip)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// connLimiter 对一条规则下的并发连接数做整体和按源IP两种限制，在
+// StatsListener.handleRawConn中每次成功Accept之后、交给socks5.Server之前检查。
+type connLimiter struct {
+	maxConns      int
+	maxConnsPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(maxConns, maxConnsPerIP int) *connLimiter {
+	return &connLimiter{
+		maxConns:      maxConns,
+		maxConnsPerIP: maxConnsPerIP,
+		perIP:         make(map[string]int),
+	}
+}
+
+// allow 尝试为来自ip的一条新连接占一个名额；成功则返回true，调用方在连接关闭后
+// 必须调用release(ip)归还名额。
+func (l *connLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		return false
+	}
+	if l.maxConnsPerIP > 0 && l.perIP[ip] >= l.maxConnsPerIP {
+		return false
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// limitedConn 在Close时把自己的名额归还给connLimiter。
+type limitedConn struct {
+	net.Conn
+	limiter *connLimiter
+	ip      string
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limiter.release(c.ip) })
+	return c.Conn.Close()
+}
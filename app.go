@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/things-go/go-socks5"
@@ -16,16 +17,38 @@ import (
 
 // SocksRule represents a SOCKS5 server rule
 type SocksRule struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	Port          int    `json:"port"`
-	Username      string `json:"username"`
-	Password      string `json:"password"`
-	NoAuth        bool   `json:"noAuth"`
-	Running       bool   `json:"running"`
-	EnableUDP     bool   `json:"enableUDP"`
-	UploadBytes   int64  `json:"uploadBytes"`
-	DownloadBytes int64  `json:"downloadBytes"`
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Port          int       `json:"port"`
+	Username      string    `json:"username"`
+	Password      string    `json:"password"`
+	NoAuth        bool      `json:"noAuth"`
+	Running       bool      `json:"running"`
+	EnableUDP     bool      `json:"enableUDP"`
+	UploadBytes   int64     `json:"uploadBytes"`
+	DownloadBytes int64     `json:"downloadBytes"`
+	BindMode      string    `json:"bindMode"`                // tcp（默认）、unix 或 fd@N，例如 fd@3
+	ProxyProtocol string    `json:"proxyProtocol"`           // off（默认）、v1、v2 或 v2-tlvs
+	ACL           ACLConfig `json:"acl,omitempty"`           // 来源/目标允许拒绝列表
+	MaxConns      int       `json:"maxConns,omitempty"`      // 0表示不限制
+	MaxConnsPerIP int       `json:"maxConnsPerIP,omitempty"` // 0表示不限制
+
+	// Chain 是出站代理链，按顺序逐跳建立隧道，最后一跳负责CONNECT到真正的目标地址。
+	// 每一跳格式为 scheme://[user:pass@]host:port，scheme支持socks5、socks4a、http，
+	// 以及带"+tls"后缀表示先用TLS包一层（如socks5+tls://）。为空表示不经过代理链，
+	// 直接出站。
+	Chain []string `json:"chain,omitempty"`
+	// SecondaryChain 是健康检查发现主链路(Chain)首跳延迟过高或不可达时的故障转移
+	// 链路，为空表示不做故障转移。
+	SecondaryChain []string `json:"secondaryChain,omitempty"`
+	// ChainLatencyThresholdMs 是健康检查判定主链路降级的连接延迟阈值（毫秒），
+	// 0表示使用默认值。
+	ChainLatencyThresholdMs int `json:"chainLatencyThresholdMs,omitempty"`
+
+	// ListenerID 关联到结构化配置（gosker_config.json）里 listeners 段的某个
+	// ListenerConfig。设置时监听器的type/address/proxy_protocol以该定义为准，
+	// BindMode/ProxyProtocol仅在未关联或引用的监听器不存在时作为回退。
+	ListenerID string `json:"listenerID,omitempty"`
 }
 
 // App struct
@@ -36,15 +59,20 @@ type App struct {
 	listeners map[string]net.Listener
 	mu        sync.Mutex
 	counters  map[string]*TrafficCounter // 流量计数器映射
+	cfg       configState                // 结构化配置（监听器定义 + 热重载状态）
+	udpTables map[string]*connTrackTable // 每条规则的UDP ASSOCIATE NAT会话表
+	chains    map[string]*chainRuntime   // 每条规则的出站代理链运行时状态（含健康检查）
 }
 
-// TrafficCounter 用于统计流量的结构体
+// TrafficCounter 用于统计流量的结构体。上传/下载字节数使用atomic操作，可以直接在
+// TrafficConnWrapper.Read/Write的热路径里更新，不必为每个字节都争抢一把互斥锁；
+// mu只保护lastSync与"是否该同步到规则"这部分节流逻辑。
 type TrafficCounter struct {
+	uploadBytes   atomic.Int64
+	downloadBytes atomic.Int64
+	app           *App   // 对App的引用
+	ruleID        string // 规则ID
 	mu            sync.Mutex
-	uploadBytes   int64
-	downloadBytes int64
-	app           *App      // 对App的引用
-	ruleID        string    // 规则ID
 	lastSync      time.Time // 上次同步时间
 }
 
@@ -59,11 +87,12 @@ func NewTrafficCounter(app *App, ruleID string) *TrafficCounter {
 
 // CountUpload 统计上传流量
 func (t *TrafficCounter) CountUpload(n int) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.uploadBytes += int64(n)
+	t.uploadBytes.Add(int64(n))
+	metricUploadBytes.WithLabelValues(t.ruleID).Add(float64(n))
 
 	// 每隔一段时间将流量数据同步到规则中
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	if time.Since(t.lastSync) > 3*time.Second {
 		t.syncToRule()
 	}
@@ -71,19 +100,21 @@ func (t *TrafficCounter) CountUpload(n int) {
 
 // CountDownload 统计下载流量
 func (t *TrafficCounter) CountDownload(n int) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.downloadBytes += int64(n)
+	t.downloadBytes.Add(int64(n))
+	metricDownloadBytes.WithLabelValues(t.ruleID).Add(float64(n))
 
 	// 每隔一段时间将流量数据同步到规则中
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	if time.Since(t.lastSync) > 3*time.Second {
 		t.syncToRule()
 	}
 }
 
-// 将流量数据同步到规则中
+// 将流量数据同步到规则中。调用者必须持有t.mu。
 func (t *TrafficCounter) syncToRule() {
-	// 已经持有t.mu锁，不要在这里再次获取
+	upload := t.uploadBytes.Swap(0)
+	download := t.downloadBytes.Swap(0)
 
 	// 获取App锁以更新规则
 	t.app.mu.Lock()
@@ -92,11 +123,8 @@ func (t *TrafficCounter) syncToRule() {
 	// 更新对应规则的流量数据
 	for i, rule := range t.app.rules {
 		if rule.ID == t.ruleID {
-			t.app.rules[i].UploadBytes += t.uploadBytes
-			t.app.rules[i].DownloadBytes += t.downloadBytes
-			// 重置计数器
-			t.uploadBytes = 0
-			t.downloadBytes = 0
+			t.app.rules[i].UploadBytes += upload
+			t.app.rules[i].DownloadBytes += download
 			t.lastSync = time.Now()
 
 			// 每10次流量更新，保存一次规则数据
@@ -111,23 +139,30 @@ func (t *TrafficCounter) syncToRule() {
 
 // GetStats 获取流量统计
 func (t *TrafficCounter) GetStats() (int64, int64) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.uploadBytes, t.downloadBytes
+	return t.uploadBytes.Load(), t.downloadBytes.Load()
 }
 
 // Reset 重置流量统计
 func (t *TrafficCounter) Reset() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.uploadBytes = 0
-	t.downloadBytes = 0
+	t.uploadBytes.Store(0)
+	t.downloadBytes.Store(0)
 }
 
-// 自定义连接包装器，用于统计流量
+// 自定义连接包装器，用于统计流量，并在连接关闭时上报Prometheus的连接时长指标
 type TrafficConnWrapper struct {
 	net.Conn
-	counter *TrafficCounter
+	counter    *TrafficCounter
+	ruleID     string
+	acceptedAt time.Time
+	closeOnce  sync.Once
+}
+
+// Close 关闭底层连接，并记录这条连接从accept到close的总时长
+func (c *TrafficConnWrapper) Close() error {
+	c.closeOnce.Do(func() {
+		recordConnClosed(c.ruleID, c.acceptedAt)
+	})
+	return c.Conn.Close()
 }
 
 // Read 重写Read方法统计下载流量
@@ -155,6 +190,8 @@ func NewApp() *App {
 		servers:   make(map[string]*socks5.Server),
 		listeners: make(map[string]net.Listener),
 		counters:  make(map[string]*TrafficCounter),
+		udpTables: make(map[string]*connTrackTable),
+		chains:    make(map[string]*chainRuntime),
 	}
 }
 
@@ -166,8 +203,11 @@ const configFile = "gosker_rules.json"
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
 
-	// 启动时加载保存的规则
-	a.loadRules()
+	// 加载结构化配置（首次运行时自动从旧版gosker_rules.json迁移），并开始
+	// 监听配置文件变化以支持热重载
+	if err := a.StartConfigWatch(); err != nil {
+		fmt.Printf("加载结构化配置失败: %v\n", err)
+	}
 
 	// 打印加载信息，帮助调试
 	fmt.Printf("应用启动，成功加载 %d 条规则\n", len(a.rules))
@@ -175,6 +215,14 @@ func (a *App) startup(ctx context.Context) {
 
 // shutdown is called when the app is about to shutdown
 func (a *App) shutdown(ctx context.Context) {
+	// 停止配置文件监听，避免watcher goroutine泄漏
+	a.cfg.mu.Lock()
+	if a.cfg.watcher != nil {
+		a.cfg.watcher.Close()
+		a.cfg.watcher = nil
+	}
+	a.cfg.mu.Unlock()
+
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -195,6 +243,8 @@ func (a *App) shutdown(ctx context.Context) {
 	a.servers = make(map[string]*socks5.Server)
 	a.listeners = make(map[string]net.Listener)
 	a.counters = make(map[string]*TrafficCounter)
+	a.udpTables = make(map[string]*connTrackTable)
+	a.chains = make(map[string]*chainRuntime)
 }
 
 // GetRules returns all SOCKS5 rules
@@ -320,27 +370,54 @@ func (a *App) startServerLocked(id string) bool {
 	var serverOpts []socks5.Option
 
 	// 如果启用UDP，设置BindIP
+	permitCommand := socks5.PermitCommand{EnableConnect: true}
 	if rule.EnableUDP {
 		// 使用0.0.0.0作为绑定IP，允许所有网络接口的UDP连接
 		serverOpts = append(serverOpts, socks5.WithBindIP(net.ParseIP("0.0.0.0")))
 
 		// 配置UDP专用选项 - 启用ASSOCIATE命令支持UDP
-		permitCommand := &socks5.PermitCommand{
-			EnableConnect:   true,
-			EnableBind:      true,
-			EnableAssociate: true, // 确保开启UDP关联功能
-		}
-		serverOpts = append(serverOpts, socks5.WithRule(permitCommand))
+		permitCommand.EnableBind = true
+		permitCommand.EnableAssociate = true // 确保开启UDP关联功能
+
+		// 用自定义实现替换内置的ASSOCIATE处理：在转发数据报的同时维护NAT会话表
+		// 并把字节数计入现有的TrafficCounter
+		table := newConnTrackTable()
+		a.udpTables[id] = table
+		serverOpts = append(serverOpts, socks5.WithAssociateHandle(a.newUDPAssociateHandle(id, a.counters[id], table)))
 
 		// 可选：添加调试日志
 		fmt.Printf("启用UDP转发支持，端口: %d\n", rule.Port)
 	}
+	// ACL（来源/目标允许拒绝列表）与命令过滤统一走同一个RuleSet
+	serverOpts = append(serverOpts, socks5.WithRule(newACLRuleSet(permitCommand, rule.ACL)))
+
+	// 出站代理链：配置了Chain时不直接出站，而是逐跳通过链路CONNECT到目标，
+	// 并由健康检查goroutine在主链路延迟过高/不可达时故障转移到备用链路
+	if len(rule.Chain) > 0 {
+		primary, err := parseChain(rule.Chain)
+		if err != nil {
+			fmt.Printf("解析代理链失败: %v\n", err)
+			return false
+		}
+		secondary, err := parseChain(rule.SecondaryChain)
+		if err != nil {
+			fmt.Printf("解析备用代理链失败: %v\n", err)
+			return false
+		}
+
+		rt := newChainRuntime(primary, secondary, rule.ChainLatencyThresholdMs)
+		a.chains[id] = rt
+		go rt.runHealthCheck(id)
+
+		serverOpts = append(serverOpts, socks5.WithDial(a.newChainDialFunc(id)))
+	}
 
 	// 设置身份验证方法
 	if !rule.NoAuth {
-		// 使用用户名/密码认证
-		creds := socks5.StaticCredentials{
-			rule.Username: rule.Password,
+		// 使用用户名/密码认证，同时把认证失败计入Prometheus指标
+		creds := auditingCredentials{
+			ruleID: id,
+			creds:  map[string]string{rule.Username: rule.Password},
 		}
 		serverOpts = append(serverOpts, socks5.WithCredential(creds))
 	}
@@ -348,23 +425,40 @@ func (a *App) startServerLocked(id string) bool {
 	// 创建SOCKS5服务器
 	server := socks5.NewServer(serverOpts...)
 
-	// 启动监听
-	addr := fmt.Sprintf(":%d", rule.Port)
-	listener, err := net.Listen("tcp", addr)
+	// 并发连接数限制（整体 + 按源IP）
+	limiter := newConnLimiter(rule.MaxConns, rule.MaxConnsPerIP)
+
+	// 启动监听：优先使用规则通过ListenerID关联的结构化监听器定义，否则回退到
+	// 规则自身的BindMode（tcp/unix/fd三种方式之一）
+	listener, lc, err := a.resolveListenerForRule(rule)
 	if err != nil {
+		fmt.Printf("创建监听器失败: %v\n", err)
 		return false
 	}
 
+	// 关联的监听器定义了proxy_protocol时以其为准，否则使用规则自身的配置
+	proxyProtocolMode := rule.ProxyProtocol
+	bindIsTCP := rule.BindMode == "" || rule.BindMode == "tcp"
+	if lc != nil {
+		if lc.ProxyProtocol != "" {
+			proxyProtocolMode = lc.ProxyProtocol
+		}
+		bindIsTCP = lc.Type == "" || lc.Type == "tcp"
+	}
+
 	// 创建一个带流量统计的监听器包装
 	statsListener := &StatsListener{
-		Listener: listener,
-		counter:  a.counters[id],
-		app:      a,
-		ruleID:   id,
+		Listener:      listener,
+		counter:       a.counters[id],
+		app:           a,
+		ruleID:        id,
+		proxyProtocol: proxyProtocolMode,
+		limiter:       limiter,
 	}
 
-	// 对于UDP转发，显式测试UDP端口可用性
-	if rule.EnableUDP {
+	// 对于UDP转发，显式测试UDP端口可用性（仅TCP绑定模式下端口号才有意义）
+	if rule.EnableUDP && bindIsTCP {
+		addr := fmt.Sprintf(":%d", rule.Port)
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
 			fmt.Printf("UDP地址解析错误: %v\n", err)
@@ -399,26 +493,105 @@ func (a *App) startServerLocked(id string) bool {
 	return true
 }
 
-// StatsListener 是一个带有流量统计功能的监听器包装器
+// StatsListener 是一个带有流量统计功能的监听器包装器。
+//
+// PROXY协议头部的解析依赖客户端发来的字节，属于客户端可控的I/O；如果直接在
+// Accept()里同步解析，socks5.Server.Serve()那个唯一的accept循环就会被一个
+// 缓慢或恶意的客户端卡住长达proxyProtoReadTimeout，期间其他客户端完全无法
+// 建立新连接（slow-loris）。因此真正的accept由acceptLoop在后台goroutine里
+// 持续进行，每条新连接的PROXY协议解析与连接数限制检查都丢给各自独立的
+// goroutine（handleRawConn）去做，处理完成后才通过ready channel交给Accept()
+// 返回——Accept()本身永远不会阻塞在客户端可控的I/O上。
 type StatsListener struct {
 	net.Listener
-	counter *TrafficCounter
-	app     *App
-	ruleID  string
+	counter       *TrafficCounter
+	app           *App
+	ruleID        string
+	proxyProtocol string // off（默认）、v1、v2 或 v2-tlvs
+	limiter       *connLimiter
+
+	startOnce sync.Once
+	ready     chan net.Conn
+	acceptErr chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptLoop 在后台goroutine中持续调用底层Listener.Accept()；这一步只等待
+// 内核的TCP accept队列，不受任何已连接客户端的读写速度影响。每条新连接立刻
+// 被丢给handleRawConn异步处理，不阻塞下一次Accept。
+func (l *StatsListener) acceptLoop() {
+	l.ready = make(chan net.Conn)
+	l.acceptErr = make(chan error, 1)
+	l.closed = make(chan struct{})
+
+	go func() {
+		for {
+			conn, err := l.Listener.Accept()
+			if err != nil {
+				l.acceptErr <- err
+				return
+			}
+			go l.handleRawConn(conn)
+		}
+	}()
 }
 
-// Accept 接受一个连接并包装它以进行流量统计
-func (l *StatsListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
+// handleRawConn 在独立的goroutine里按需解析PROXY协议头、执行连接数限制检查，
+// 完成后把处理好的连接投递到ready channel。畸形的PROXY协议头部（或解析超时）
+// 以及超出连接数限制的连接会直接断开，不会影响其他连接。
+func (l *StatsListener) handleRawConn(conn net.Conn) {
+	if l.proxyProtocol != "" && l.proxyProtocol != "off" {
+		wrapped, err := wrapProxyProtocol(conn, l.proxyProtocol)
+		if err != nil {
+			fmt.Printf("规则 %s 丢弃畸形PROXY协议连接(%s): %v\n", l.ruleID, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if wrapped.RemoteAddr().String() != conn.RemoteAddr().String() {
+			fmt.Printf("规则 %s 通过PROXY协议还原真实客户端地址: %s\n", l.ruleID, wrapped.RemoteAddr())
+		}
+		conn = wrapped
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
-		return nil, err
+		ip = conn.RemoteAddr().String()
+	}
+	if l.limiter != nil && !l.limiter.allow(ip) {
+		fmt.Printf("规则 %s 拒绝来自 %s 的连接: 超出并发连接数限制\n", l.ruleID, ip)
+		conn.Close()
+		return
 	}
+	conn = &limitedConn{Conn: conn, limiter: l.limiter, ip: ip}
 
-	// 包装连接以进行流量统计
-	return &TrafficConnWrapper{
-		Conn:    conn,
-		counter: l.counter,
-	}, nil
+	recordConnAccepted(l.ruleID)
+	wrapper := &TrafficConnWrapper{
+		Conn:       conn,
+		counter:    l.counter,
+		ruleID:     l.ruleID,
+		acceptedAt: time.Now(),
+	}
+
+	select {
+	case l.ready <- wrapper:
+	case <-l.closed:
+		// 监听器已关闭，没有人会再读取ready channel，丢弃这条连接避免goroutine泄漏
+		wrapper.Close()
+	}
+}
+
+// Accept 从后台acceptLoop处理好的连接里取出下一条，永远不会阻塞在客户端可控
+// 的I/O（PROXY协议解析）上。
+func (l *StatsListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(l.acceptLoop)
+
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case err := <-l.acceptErr:
+		return nil, err
+	}
 }
 
 // Close 关闭监听器并执行清理
@@ -435,13 +608,8 @@ func (l *StatsListener) Close() error {
 		// 尝试同步流量数据，但使用超时保护避免长时间阻塞
 		syncDone := make(chan bool, 1)
 		go func() {
-			l.counter.mu.Lock()
-			defer l.counter.mu.Unlock()
-
-			if l.counter.uploadBytes > 0 || l.counter.downloadBytes > 0 {
-				// 尝试同步，但不再调用syncToRule (可能会导致死锁)
-				// 而是直接在stopServerLocked中处理流量统计
-			}
+			// 流量统计本身已经是atomic的，这里不需要再次同步；
+			// 实际的"落盘到规则"交给stopServerLocked处理，避免死锁
 			syncDone <- true
 		}()
 
@@ -455,6 +623,14 @@ func (l *StatsListener) Close() error {
 		}
 	}
 
+	// 通知所有仍在处理PROXY协议解析的handleRawConn goroutine停止投递，避免
+	// 它们永远阻塞在向ready channel发送上而泄漏
+	l.closeOnce.Do(func() {
+		if l.closed != nil {
+			close(l.closed)
+		}
+	})
+
 	// 最后关闭底层监听器
 	return l.Listener.Close()
 }
@@ -487,24 +663,36 @@ func (a *App) stopServerLocked(id string) bool {
 
 	// 先保存当前的流量统计数据，以防在关闭过程中发生崩溃
 	if counter, ok := a.counters[id]; ok && counter != nil {
-		counter.mu.Lock()
-		if counter.uploadBytes > 0 || counter.downloadBytes > 0 {
+		upload := counter.uploadBytes.Swap(0)
+		download := counter.downloadBytes.Swap(0)
+		if upload > 0 || download > 0 {
 			// 手动同步流量数据
 			for i, r := range a.rules {
 				if r.ID == id {
-					a.rules[i].UploadBytes += counter.uploadBytes
-					a.rules[i].DownloadBytes += counter.downloadBytes
+					a.rules[i].UploadBytes += upload
+					a.rules[i].DownloadBytes += download
 					break
 				}
 			}
 		}
-		counter.mu.Unlock()
 	}
 
 	// 删除计数器和服务器
 	delete(a.counters, id)
 	delete(a.servers, id)
 
+	// 关闭该规则下所有仍然活跃的UDP ASSOCIATE会话
+	if table, ok := a.udpTables[id]; ok {
+		table.closeAll()
+		delete(a.udpTables, id)
+	}
+
+	// 停止该规则的代理链健康检查goroutine
+	if rt, ok := a.chains[id]; ok {
+		close(rt.stop)
+		delete(a.chains, id)
+	}
+
 	// Close the listener - 这通常会触发StatsListener.Close()方法
 	// 但现在我们已经保存了流量数据，所以这里即使出错也没关系
 	if listener, ok := a.listeners[id]; ok {
@@ -637,6 +825,13 @@ func (a *App) saveRules() error {
 	}
 
 	fmt.Printf("已保存配置到文件: %s\n", configPath)
+
+	// 同步写入结构化配置文件：一旦gosker_config.json存在，下次启动只会读它，
+	// 只写旧版文件会让AddRule/UpdateRule/DeleteRule等运行时变更在重启后消失
+	if err := a.saveStructuredConfigLocked(); err != nil {
+		fmt.Printf("保存结构化配置失败: %v\n", err)
+	}
+
 	return nil
 }
 
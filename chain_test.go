@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readN在超时时间内从conn读出恰好n字节；仅在测试主goroutine里调用t.Fatalf是
+// 安全的，这个辅助函数本身不持有*testing.T，可以在后台goroutine里复用。
+func readN(conn net.Conn, n int) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second)) //nolint:errcheck
+	buf := make([]byte, n)
+	_, err := io.ReadFull(conn, buf)
+	return buf, err
+}
+
+// TestSocks5ConnectPreservesTrailingBytes验证socks5Connect握手成功后返回的
+// conn不会丢失紧跟在CONNECT回复之后、与回复同一次系统调用到达的数据——真实
+// 场景里这部分字节就是目标服务器通过隧道发回的第一段业务数据。
+func TestSocks5ConnectPreservesTrailingBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	const trailing = "hello from upstream"
+
+	go func() {
+		greeting, err := readN(server, 3)
+		if err != nil || greeting[0] != 0x05 {
+			return
+		}
+		server.Write([]byte{0x05, 0x00}) //nolint:errcheck
+
+		// 读取CONNECT请求：VER+CMD+RSV+ATYP+len(host)+host+port
+		head, err := readN(server, 5)
+		if err != nil {
+			return
+		}
+		if _, err := readN(server, int(head[4])+2); err != nil {
+			return
+		}
+
+		// 关键点：CONNECT回复与隧道建立后紧跟的业务数据在同一次Write里发出，
+		// 模拟它们在同一个TCP分段里到达客户端的情形
+		reply := []byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 80}
+		server.Write(append(reply, []byte(trailing)...)) //nolint:errcheck
+	}()
+
+	hop := chainHop{scheme: "socks5"}
+	conn, err := socks5Connect(client, hop, "example.com:80")
+	if err != nil {
+		t.Fatalf("socks5Connect失败: %v", err)
+	}
+
+	got, err := readN(conn, len(trailing))
+	if err != nil {
+		t.Fatalf("读取握手之后的数据失败: %v", err)
+	}
+	if !bytes.Equal(got, []byte(trailing)) {
+		t.Fatalf("握手之后的数据丢失，got=%q want=%q", got, trailing)
+	}
+}
+
+// TestSocks4aConnectPreservesTrailingBytes与上面的用例对应，覆盖
+// socks4aConnect这条路径。
+func TestSocks4aConnectPreservesTrailingBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	const trailing = "hello from upstream"
+
+	go func() {
+		if _, err := readN(server, 8); err != nil { // VER+CMD+PORT(2)+DSTIP(4)
+			return
+		}
+		// USERID\0 + DOMAIN\0，长度不定，逐字节读到第二个\0为止
+		nulls := 0
+		for nulls < 2 {
+			b, err := readN(server, 1)
+			if err != nil {
+				return
+			}
+			if b[0] == 0 {
+				nulls++
+			}
+		}
+
+		reply := []byte{0x00, 0x5A, 0, 0, 0, 0, 0, 0}
+		server.Write(append(reply, []byte(trailing)...)) //nolint:errcheck
+	}()
+
+	conn, err := socks4aConnect(client, "example.com:80")
+	if err != nil {
+		t.Fatalf("socks4aConnect失败: %v", err)
+	}
+
+	got, err := readN(conn, len(trailing))
+	if err != nil {
+		t.Fatalf("读取握手之后的数据失败: %v", err)
+	}
+	if !bytes.Equal(got, []byte(trailing)) {
+		t.Fatalf("握手之后的数据丢失，got=%q want=%q", got, trailing)
+	}
+}
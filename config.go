@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// 新版结构化配置文件名（JSON/YAML 均可，按扩展名区分）
+const structuredConfigFile = "gosker_config.json"
+
+// ListenerConfig describes a single network listener that one or more rules
+// can be bound to. This is the building block of the multi-listener config
+// schema that replaces the old one-rule-one-port assumption.
+type ListenerConfig struct {
+	ID            string `json:"id" yaml:"id"`
+	Type          string `json:"type" yaml:"type"` // tcp | unix | fd
+	Address       string `json:"address" yaml:"address"`
+	ProxyProtocol string `json:"proxy_protocol,omitempty" yaml:"proxy_protocol,omitempty"` // off|v1|v2
+	Keepalive     int    `json:"keepalive,omitempty" yaml:"keepalive,omitempty"`           // 秒，0 表示使用系统默认值
+}
+
+// ConfigDoc is the top-level structured configuration document. It is what
+// gets loaded from / saved to gosker_config.json (or .yaml).
+type ConfigDoc struct {
+	Version   int              `json:"version" yaml:"version"`
+	Listeners []ListenerConfig `json:"listeners" yaml:"listeners"`
+	Rules     []SocksRule      `json:"rules" yaml:"rules"`
+}
+
+// configState 保存与结构化配置、热重载相关的运行时状态，与 App 的核心字段分开
+// 存放，避免 app.go 里原本的规则相关逻辑被过多新字段稀释。
+type configState struct {
+	mu        sync.Mutex
+	path      string
+	listeners map[string]ListenerConfig
+	watcher   *fsnotify.Watcher
+}
+
+// configFilePath 返回结构化配置文件应当所在的路径（与旧版规则文件同目录）。
+// 同目录下已有 gosker_config.yaml 或 gosker_config.yml 时使用它，否则使用
+// gosker_config.json。
+func configFilePath() string {
+	exePath, err := os.Executable()
+	if err != nil {
+		return structuredConfigFile
+	}
+	dir := filepath.Dir(exePath)
+	for _, name := range []string{"gosker_config.yaml", "gosker_config.yml"} {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(dir, structuredConfigFile)
+}
+
+// loadConfigDoc 根据文件扩展名解析 JSON 或 YAML 格式的配置文档。
+func loadConfigDoc(path string) (*ConfigDoc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc ConfigDoc
+	if isYAMLPath(path) {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("解析YAML配置失败: %v", err)
+		}
+	} else {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("解析JSON配置失败: %v", err)
+		}
+	}
+
+	return &doc, nil
+}
+
+// saveConfigDoc 按照目标路径的扩展名，将配置文档写成 JSON 或 YAML。
+func saveConfigDoc(path string, doc *ConfigDoc) error {
+	var data []byte
+	var err error
+
+	if isYAMLPath(path) {
+		data, err = yaml.Marshal(doc)
+	} else {
+		data, err = json.MarshalIndent(doc, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("序列化配置失败: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("创建配置目录失败: %v", err)
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func isYAMLPath(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// migrateFlatRules 将旧版的扁平 []SocksRule 配置（gosker_rules.json）迁移为新的
+// 多监听器 ConfigDoc 结构：每条规则按端口生成一个同名的 TCP 监听器，规则本身不
+// 做其他改动，仅用于首次升级时保留用户已有的配置。
+func migrateFlatRules(rules []SocksRule) *ConfigDoc {
+	doc := &ConfigDoc{Version: 1}
+
+	for _, rule := range rules {
+		listenerID := rule.ID
+		doc.Listeners = append(doc.Listeners, ListenerConfig{
+			ID:      listenerID,
+			Type:    "tcp",
+			Address: fmt.Sprintf(":%d", rule.Port),
+		})
+		rule.ListenerID = listenerID
+		doc.Rules = append(doc.Rules, rule)
+	}
+
+	return doc
+}
+
+// loadStructuredConfig 加载结构化配置：若新格式文件不存在但旧版规则文件存在，
+// 先从旧版文件迁移一次并落盘，再返回迁移后的文档。
+func (a *App) loadStructuredConfig() (*ConfigDoc, error) {
+	path := configFilePath()
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		legacyPath := getConfigFilePath()
+		if _, err := os.Stat(legacyPath); err == nil {
+			data, err := os.ReadFile(legacyPath)
+			if err != nil {
+				return nil, err
+			}
+			var legacyRules []SocksRule
+			if err := json.Unmarshal(data, &legacyRules); err != nil {
+				return nil, fmt.Errorf("解析旧版规则文件失败: %v", err)
+			}
+
+			doc := migrateFlatRules(legacyRules)
+			if err := saveConfigDoc(path, doc); err != nil {
+				return nil, err
+			}
+			fmt.Printf("已将旧版配置 %s 迁移到 %s\n", legacyPath, path)
+			return doc, nil
+		}
+
+		return &ConfigDoc{Version: 1}, nil
+	}
+
+	return loadConfigDoc(path)
+}
+
+// StartConfigWatch 启动结构化配置文件，并开始监听其变化以便热重载。
+func (a *App) StartConfigWatch() error {
+	doc, err := a.loadStructuredConfig()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.applyConfigDocLocked(doc)
+	a.mu.Unlock()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("创建配置监听器失败: %v", err)
+	}
+
+	path := configFilePath()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("监听配置目录失败: %v", err)
+	}
+
+	a.cfg.mu.Lock()
+	a.cfg.path = path
+	a.cfg.watcher = watcher
+	a.cfg.mu.Unlock()
+
+	go a.watchConfigLoop(watcher, path)
+
+	return nil
+}
+
+// watchConfigLoop 监听配置文件写入事件，命中时触发一次热重载。
+func (a *App) watchConfigLoop(watcher *fsnotify.Watcher, path string) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := a.ReloadConfig(); err != nil {
+				fmt.Printf("热重载配置失败: %v\n", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("配置监听器错误: %v\n", err)
+		}
+	}
+}
+
+// ReloadConfig re-reads the structured config file from disk and applies only
+// the rules whose definition actually changed, diffing by rule ID so that
+// untouched SOCKS5 listeners keep serving active connections.
+func (a *App) ReloadConfig() error {
+	doc, err := loadConfigDoc(configFilePath())
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.applyConfigDocLocked(doc)
+
+	return nil
+}
+
+// normalizeForCompare 返回r清零Running/UploadBytes/DownloadBytes等运行时字段
+// 后的副本，使applyConfigDocLocked的DeepEqual只比较配置本身。这三个字段会在
+// 服务运行期间持续变化并通过saveRules/saveStructuredConfigLocked落盘，如果不
+// 剔除就直接比较，热重载会把"规则配置没变，只是流量计数器涨了"也误判为变化，
+// 进而重启服务器、掉线已有的连接。
+func normalizeForCompare(r SocksRule) SocksRule {
+	r.Running = false
+	r.UploadBytes = 0
+	r.DownloadBytes = 0
+	return r
+}
+
+// applyConfigDocLocked diff 新旧规则（按 ID），只对发生变化的规则执行
+// 停止/重启，未变化的规则及其连接不受影响。调用者必须持有 a.mu。
+func (a *App) applyConfigDocLocked(doc *ConfigDoc) {
+	a.cfg.mu.Lock()
+	a.cfg.listeners = make(map[string]ListenerConfig, len(doc.Listeners))
+	for _, l := range doc.Listeners {
+		a.cfg.listeners[l.ID] = l
+	}
+	a.cfg.mu.Unlock()
+
+	oldByID := make(map[string]SocksRule, len(a.rules))
+	for _, r := range a.rules {
+		oldByID[r.ID] = r
+	}
+
+	newByID := make(map[string]bool, len(doc.Rules))
+	for _, r := range doc.Rules {
+		newByID[r.ID] = true
+	}
+
+	for id, old := range oldByID {
+		if !newByID[id] && old.Running {
+			a.stopServerLocked(id)
+		}
+	}
+
+	a.rules = doc.Rules
+
+	for i := range a.rules {
+		rule := a.rules[i]
+		old, existed := oldByID[rule.ID]
+		changed := !existed || !reflect.DeepEqual(normalizeForCompare(old), normalizeForCompare(rule))
+
+		if existed && old.Running {
+			// 文档里的规则落盘时Running恒为false，先恢复内存中的运行状态：未变化的
+			// 规则继续服务，变化的规则才能被stopServerLocked真正停止后再重启
+			a.rules[i].Running = true
+			if !changed {
+				continue
+			}
+			a.stopServerLocked(rule.ID)
+			rule.Running = true
+		}
+		if changed && rule.Running {
+			a.rules[i].Running = false
+			a.startServerLocked(rule.ID)
+		}
+	}
+
+	a.saveRules()
+}
+
+// saveStructuredConfigLocked 把当前规则与监听器定义写入结构化配置文件。
+// loadStructuredConfig只在gosker_config.json首次从旧版文件迁移时写过一次，
+// 此后AddRule/UpdateRule/DeleteRule/StartServer/StopServer等运行时变更若只
+// 调用saveRules，就只会落到旧版gosker_rules.json里——而一旦gosker_config.json
+// 已经存在，下次启动只会读它，旧版文件的更新无声无息地被忽略。saveRules统一
+// 调用本函数，让两个文件始终保持同步。调用者必须持有a.mu。
+func (a *App) saveStructuredConfigLocked() error {
+	saveRules := make([]SocksRule, len(a.rules))
+	for i, rule := range a.rules {
+		rule.Running = false // 与saveRules一致：落盘时不记录运行状态
+		saveRules[i] = rule
+	}
+
+	a.cfg.mu.Lock()
+	doc := &ConfigDoc{Version: 1, Rules: saveRules}
+	for _, l := range a.cfg.listeners {
+		doc.Listeners = append(doc.Listeners, l)
+	}
+	a.cfg.mu.Unlock()
+
+	return saveConfigDoc(configFilePath(), doc)
+}
+
+// ExportConfig serializes the current listeners and rules into a structured
+// JSON document, for the frontend to display or let the user download.
+func (a *App) ExportConfig() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cfg.mu.Lock()
+	doc := &ConfigDoc{Version: 1, Rules: a.rules}
+	for _, l := range a.cfg.listeners {
+		doc.Listeners = append(doc.Listeners, l)
+	}
+	a.cfg.mu.Unlock()
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("序列化配置失败: %v", err)
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixSocketDir 是 BindMode 为 "unix" 时规则监听的 Unix 域套接字所在目录。
+const unixSocketDir = "/var/run/gosker"
+
+// resolveListenerForRule 优先使用规则通过 ListenerID 关联的结构化监听器定义
+// （来自 gosker_config.json 的 listeners 段），在未配置关联或引用的监听器不
+// 存在时回退到规则自身的 BindMode/Port 字段，保证没有 listeners 段的旧配置
+// 依然可用。
+func (a *App) resolveListenerForRule(rule *SocksRule) (net.Listener, *ListenerConfig, error) {
+	if rule.ListenerID == "" {
+		listener, err := resolveListener(rule)
+		return listener, nil, err
+	}
+
+	a.cfg.mu.Lock()
+	lc, ok := a.cfg.listeners[rule.ListenerID]
+	a.cfg.mu.Unlock()
+
+	if !ok {
+		fmt.Printf("规则 %s 引用的监听器 %s 未找到，回退到BindMode\n", rule.ID, rule.ListenerID)
+		listener, err := resolveListener(rule)
+		return listener, nil, err
+	}
+
+	listener, err := resolveListenerFromConfig(rule, &lc)
+	return listener, &lc, err
+}
+
+// resolveListener 根据规则的 BindMode 打开对应的监听器：
+//   - "" 或 "tcp"：照旧使用 net.Listen("tcp", addr)
+//   - "unix"：在 unixSocketDir 下按规则 ID 创建 Unix 域套接字，适用于仅本地使用的场景
+//   - "fd@N"：复用编号为 N 的已打开文件描述符（由 systemd/launchd/einhorn 等传入），
+//     从而支持socket activation与不丢连接的优雅重启
+func resolveListener(rule *SocksRule) (net.Listener, error) {
+	mode := rule.BindMode
+	if mode == "" {
+		mode = "tcp"
+	}
+
+	switch {
+	case mode == "tcp":
+		addr := fmt.Sprintf(":%d", rule.Port)
+		return net.Listen("tcp", addr)
+
+	case mode == "unix":
+		return openUnixListener(filepath.Join(unixSocketDir, rule.ID+".sock"))
+
+	case strings.HasPrefix(mode, "fd@"):
+		return openFDListener(strings.TrimPrefix(mode, "fd@"))
+
+	default:
+		return nil, fmt.Errorf("未知的BindMode: %q", mode)
+	}
+}
+
+// resolveListenerFromConfig 根据结构化配置里的 ListenerConfig（type/address）
+// 打开监听器，供通过 ListenerID 关联到某个 listener 的规则使用。
+func resolveListenerFromConfig(rule *SocksRule, lc *ListenerConfig) (net.Listener, error) {
+	switch lc.Type {
+	case "", "tcp":
+		addr := lc.Address
+		if addr == "" {
+			addr = fmt.Sprintf(":%d", rule.Port)
+		}
+		// Keepalive为0时net.ListenConfig使用默认的TCP keep-alive周期
+		lcfg := net.ListenConfig{KeepAlive: time.Duration(lc.Keepalive) * time.Second}
+		return lcfg.Listen(context.Background(), "tcp", addr)
+
+	case "unix":
+		sockPath := lc.Address
+		if sockPath == "" {
+			sockPath = filepath.Join(unixSocketDir, rule.ID+".sock")
+		}
+		return openUnixListener(sockPath)
+
+	case "fd":
+		return openFDListener(strings.TrimPrefix(lc.Address, "fd@"))
+
+	default:
+		return nil, fmt.Errorf("未知的监听器类型: %q", lc.Type)
+	}
+}
+
+// openUnixListener 在sockPath创建一个Unix域套接字监听器，复用前会先清理残留的
+// 套接字文件，否则 net.Listen 会返回 "address already in use"。
+func openUnixListener(sockPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0755); err != nil {
+		return nil, fmt.Errorf("创建unix套接字目录失败: %v", err)
+	}
+	os.Remove(sockPath)
+	return net.Listen("unix", sockPath)
+}
+
+// openFDListener 复用编号为fdStr的已打开文件描述符（由 systemd/launchd/einhorn
+// 等传入），从而支持socket activation与不丢连接的优雅重启。
+func openFDListener(fdStr string) (net.Listener, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的fd %q: %v", fdStr, err)
+	}
+
+	name := fmt.Sprintf("gosker-fd-%d", fd)
+	f := os.NewFile(uintptr(fd), name)
+	if f == nil {
+		return nil, fmt.Errorf("fd %d 不是一个有效的文件描述符", fd)
+	}
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("从fd %d 创建监听器失败: %v", fd, err)
+	}
+	// net.FileListener会dup一份fd，原始的f可以关闭
+	f.Close()
+	return listener, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// gosker的Prometheus指标均以ruleID作为标签，与StatsListener/TrafficConnWrapper一一对应。
+var (
+	metricUploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosker_upload_bytes_total",
+		Help: "Total bytes uploaded (client -> target) per rule.",
+	}, []string{"rule"})
+
+	metricDownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosker_download_bytes_total",
+		Help: "Total bytes downloaded (target -> client) per rule.",
+	}, []string{"rule"})
+
+	metricConnectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosker_connections_total",
+		Help: "Total number of accepted connections per rule.",
+	}, []string{"rule"})
+
+	metricActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gosker_active_connections",
+		Help: "Number of currently open connections per rule.",
+	}, []string{"rule"})
+
+	metricAuthFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosker_auth_failures_total",
+		Help: "Total number of authentication failures per rule.",
+	}, []string{"rule"})
+
+	metricConnDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gosker_connection_duration_seconds",
+		Help:    "Connection lifetime, from accept to close, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"rule"})
+
+	metricsRegistry = prometheus.NewRegistry()
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricUploadBytes,
+		metricDownloadBytes,
+		metricConnectionsTotal,
+		metricActiveConnections,
+		metricAuthFailuresTotal,
+		metricConnDuration,
+	)
+}
+
+// StartMetrics opts in to exposing a Prometheus-compatible /metrics endpoint
+// on addr (e.g. ":9090"). It is disabled by default; call it once at startup
+// if metrics scraping is wanted.
+func (a *App) StartMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		fmt.Printf("Prometheus指标服务监听于 %s/metrics\n", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("指标服务退出: %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// recordConnAccepted 在一条新连接被放行时更新计数/Gauge类指标。
+func recordConnAccepted(ruleID string) {
+	metricConnectionsTotal.WithLabelValues(ruleID).Inc()
+	metricActiveConnections.WithLabelValues(ruleID).Inc()
+}
+
+// recordConnClosed 在连接关闭时回收Gauge并记录这次连接的持续时长。
+func recordConnClosed(ruleID string, startedAt time.Time) {
+	metricActiveConnections.WithLabelValues(ruleID).Dec()
+	metricConnDuration.WithLabelValues(ruleID).Observe(time.Since(startedAt).Seconds())
+}
+
+// recordAuthFailure 在认证失败时计数；目前通过go-socks5的CredentialStore包装调用。
+func recordAuthFailure(ruleID string) {
+	metricAuthFailuresTotal.WithLabelValues(ruleID).Inc()
+}
+
+// auditingCredentials 包裹socks5.StaticCredentials，在认证失败时额外上报指标，
+// 不改变原有的认证判定逻辑。
+type auditingCredentials struct {
+	ruleID string
+	creds  map[string]string
+}
+
+func (c auditingCredentials) Valid(user, password, _ string) bool {
+	pass, found := c.creds[user]
+	ok := found && pass == password
+	if !ok {
+		recordAuthFailure(c.ruleID)
+	}
+	return ok
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyProtoReadTimeout 是解析PROXY协议头部时允许的最长耗时，超时即视为
+// 畸形/恶意连接并直接断开。解析本身发生在每条连接各自的goroutine里（见
+// StatsListener.acceptLoop），不会拖慢Accept()接受下一条连接。
+const proxyProtoReadTimeout = 5 * time.Second
+
+// proxyProtoV1MaxLen 是PROXY protocol v1文本头部的最大长度（不含末尾的\n），
+// 取自HAProxy规范对v1头部107字节的上限，防止没有换行符的畸形头部让
+// bufio.Reader无限增长缓冲区。
+const proxyProtoV1MaxLen = 107
+
+// proxyProtoV2Signature 是PROXY protocol v2二进制格式固定的12字节签名。
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// addrOverrideConn 包裹一个net.Conn，用解析出的真实客户端地址覆盖RemoteAddr()，
+// 这样上层的socks5.Server、审计日志拿到的都是PROXY协议头里记录的原始来源地址。
+type addrOverrideConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrOverrideConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// bufferedConn 让已经被bufio.Reader窥视/消费的数据在后续Read调用中仍然可见，
+// 避免PROXY协议头之后紧跟的SOCKS5握手字节被吞掉。
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// wrapProxyProtocol 在真正交给socks5.Server之前，按需解析PROXY协议头部。
+// mode为"off"或空字符串时原样返回conn。
+func wrapProxyProtocol(conn net.Conn, mode string) (net.Conn, error) {
+	if mode == "" || mode == "off" {
+		return conn, nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProtoReadTimeout)); err != nil {
+		return nil, fmt.Errorf("设置PROXY协议读取超时失败: %v", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+
+	remoteAddr, err := parseProxyProtocolHeader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("解析PROXY协议头失败: %v", err)
+	}
+
+	wrapped := &bufferedConn{Conn: conn, r: reader}
+	if remoteAddr == nil {
+		return wrapped, nil
+	}
+	return &addrOverrideConn{Conn: wrapped, remoteAddr: remoteAddr}, nil
+}
+
+// parseProxyProtocolHeader 识别并解析v1（文本）或v2（二进制）格式的PROXY协议头，
+// 返回头部中记录的真实客户端地址；UNKNOWN/本地健康检查连接时返回nil。
+func parseProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Signature))
+	if err == nil && string(sig) == string(proxyProtoV2Signature) {
+		return parseProxyProtocolV2(r)
+	}
+
+	return parseProxyProtocolV1(r)
+}
+
+// parseProxyProtocolV1 解析HAProxy PROXY protocol v1的文本格式，形如：
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func parseProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := readBoundedLine(r, proxyProtoV1MaxLen)
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("无效的v1头部: %q", line)
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("无效的v1头部字段数: %q", line)
+	}
+
+	srcIP := fields[2]
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("无效的源端口: %v", err)
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(srcIP), Port: srcPort}, nil
+}
+
+// parseProxyProtocolV2 解析PROXY protocol v2的二进制格式：12字节签名 + 1字节
+// version/command + 1字节address-family/protocol + 2字节大端长度 + 定长地址块。
+func parseProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := readFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("不支持的PROXY协议版本: %d", verCmd>>4)
+	}
+	cmd := verCmd & 0x0F
+
+	famProto := header[13]
+	family := famProto >> 4
+
+	length := binary.BigEndian.Uint16(header[14:16])
+	body := make([]byte, length)
+	if _, err := readFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL命令（健康检查等）没有附带真实来源地址
+	if cmd == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("v2头部IPv4地址块长度不足")
+		}
+		srcIP := net.IP(body[0:4])
+		srcPort := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, nil
+
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("v2头部IPv6地址块长度不足")
+		}
+		srcIP := net.IP(body[0:16])
+		srcPort := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, nil
+
+	default:
+		// AF_UNSPEC或AF_UNIX：没有可用的TCP源地址，TLV等附加信息一并忽略
+		return nil, nil
+	}
+}
+
+// readBoundedLine 逐字节读取一行，最多读取max个字节（不含换行符本身）；
+// 超过max仍未遇到'\n'则返回错误，避免畸形/恶意头部无限增长缓冲区。
+func readBoundedLine(r *bufio.Reader, max int) (string, error) {
+	buf := make([]byte, 0, max)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return string(buf), nil
+		}
+		if len(buf) >= max {
+			return "", fmt.Errorf("v1头部超过最大长度%d字节", max)
+		}
+		buf = append(buf, b)
+	}
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
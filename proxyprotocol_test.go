@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildV2Header按PROXY protocol v2的二进制格式拼出一个完整头部（签名+定长头+
+// 地址块），用于下面的测试用例；famProto与addrBody由各用例自行给出。
+func buildV2Header(famProto byte, cmd byte, addrBody []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Signature)
+	buf.WriteByte(0x20 | cmd) // version=2, command
+	buf.WriteByte(famProto)
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(addrBody)))
+	buf.Write(length[:])
+	buf.Write(addrBody)
+	return buf.Bytes()
+}
+
+func TestParseProxyProtocolV2(t *testing.T) {
+	cases := []struct {
+		name       string
+		famProto   byte
+		cmd        byte
+		addrBody   []byte
+		wantNil    bool
+		wantIP     string
+		wantPort   int
+		wantErr    bool
+		trailingOK bool
+	}{
+		{
+			name:     "ipv4 proxy command",
+			famProto: 1 << 4, // AF_INET
+			cmd:      1,      // PROXY
+			addrBody: func() []byte {
+				body := make([]byte, 12)
+				copy(body[0:4], net.IPv4(192, 0, 2, 1).To4())
+				copy(body[4:8], net.IPv4(192, 0, 2, 2).To4())
+				binary.BigEndian.PutUint16(body[8:10], 56324)
+				binary.BigEndian.PutUint16(body[10:12], 443)
+				return body
+			}(),
+			wantIP:   "192.0.2.1",
+			wantPort: 56324,
+		},
+		{
+			name:     "ipv6 proxy command",
+			famProto: 2 << 4, // AF_INET6
+			cmd:      1,
+			addrBody: func() []byte {
+				body := make([]byte, 36)
+				copy(body[0:16], net.ParseIP("2001:db8::1").To16())
+				copy(body[16:32], net.ParseIP("2001:db8::2").To16())
+				binary.BigEndian.PutUint16(body[32:34], 12345)
+				binary.BigEndian.PutUint16(body[34:36], 443)
+				return body
+			}(),
+			wantIP:   "2001:db8::1",
+			wantPort: 12345,
+		},
+		{
+			name:     "local command has no source address",
+			famProto: 1 << 4,
+			cmd:      0, // LOCAL
+			addrBody: make([]byte, 12),
+			wantNil:  true,
+		},
+		{
+			name:     "af_unspec is ignored",
+			famProto: 0,
+			cmd:      1,
+			addrBody: nil,
+			wantNil:  true,
+		},
+		{
+			name:     "truncated ipv4 address block",
+			famProto: 1 << 4,
+			cmd:      1,
+			addrBody: make([]byte, 4), // too short for an IPv4 block
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := buildV2Header(tc.famProto, tc.cmd, tc.addrBody)
+			addr, err := parseProxyProtocolV2(bufio.NewReader(bytes.NewReader(data)))
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("期望解析失败，实际成功: %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if tc.wantNil {
+				if addr != nil {
+					t.Fatalf("期望返回nil地址，实际: %v", addr)
+				}
+				return
+			}
+
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("期望*net.TCPAddr，实际: %T", addr)
+			}
+			if !tcpAddr.IP.Equal(net.ParseIP(tc.wantIP)) {
+				t.Errorf("IP = %v, 期望 %v", tcpAddr.IP, tc.wantIP)
+			}
+			if tcpAddr.Port != tc.wantPort {
+				t.Errorf("Port = %d, 期望 %d", tcpAddr.Port, tc.wantPort)
+			}
+		})
+	}
+}
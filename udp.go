@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// udpIdleTimeout 是一条UDP流（由客户端地址+目标地址唯一确定）在没有任何数据包
+// 经过时，上游套接字被回收前允许的最长空闲时间。
+const udpIdleTimeout = 30 * time.Second
+
+// UDPSession 描述一条活跃的UDP ASSOCIATE流，供前端展示。
+type UDPSession struct {
+	ClientAddr    string    `json:"clientAddr"`
+	DestAddr      string    `json:"destAddr"`
+	UploadBytes   int64     `json:"uploadBytes"`
+	DownloadBytes int64     `json:"downloadBytes"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastActiveAt  time.Time `json:"lastActiveAt"`
+}
+
+// udpFlow 是connTrackTable中的一条表项：一个{sessionID, clientAddr, dstAddr}
+// 三元组对应一个上游*net.UDPConn，所有到同一目标的数据包复用同一个上游套接字。
+// sessionID标识这条流属于哪一次UDP ASSOCIATE会话（即哪一条TCP控制连接/哪个
+// bindLn），用于在该会话的控制连接关闭时只清理这一个会话名下的流，而不影响
+// 同一条规则上其他并发会话的流。
+type udpFlow struct {
+	sessionID     string
+	upstream      *net.UDPConn
+	clientAddr    *net.UDPAddr
+	dstAddr       statute.AddrSpec
+	uploadBytes   int64
+	downloadBytes int64
+	createdAt     time.Time
+	lastActiveAt  time.Time
+	mu            sync.Mutex
+}
+
+// connTrackTable 是一条规则下所有UDP ASSOCIATE流的NAT会话表，由该规则的所有
+// 并发ASSOCIATE会话共享；每条流都记录着自己的sessionID，closeSession只清理
+// 属于某一次会话的流，不会影响其他会话。
+type connTrackTable struct {
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func newConnTrackTable() *connTrackTable {
+	return &connTrackTable{flows: make(map[string]*udpFlow)}
+}
+
+// udpFlowKey 包含sessionID前缀，避免不同会话恰好产生相同{clientAddr, dstAddr}
+// 时互相覆盖对方的表项。
+func udpFlowKey(sessionID, clientAddr, dstAddr string) string {
+	return sessionID + "--" + clientAddr + "--" + dstAddr
+}
+
+func (t *connTrackTable) get(key string) (*udpFlow, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.flows[key]
+	return f, ok
+}
+
+func (t *connTrackTable) put(key string, f *udpFlow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flows[key] = f
+}
+
+func (t *connTrackTable) delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.flows, key)
+}
+
+// snapshot 返回当前所有活跃流的只读快照，供GetUDPSessions使用。
+func (t *connTrackTable) snapshot() []UDPSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]UDPSession, 0, len(t.flows))
+	for _, f := range t.flows {
+		f.mu.Lock()
+		sessions = append(sessions, UDPSession{
+			ClientAddr:    f.clientAddr.String(),
+			DestAddr:      f.dstAddr.String(),
+			UploadBytes:   f.uploadBytes,
+			DownloadBytes: f.downloadBytes,
+			CreatedAt:     f.createdAt,
+			LastActiveAt:  f.lastActiveAt,
+		})
+		f.mu.Unlock()
+	}
+	return sessions
+}
+
+// closeAll 关闭该规则下所有仍然打开的上游UDP套接字，仅在整条规则停止服务时调用。
+func (t *connTrackTable) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, f := range t.flows {
+		f.upstream.Close()
+		delete(t.flows, key)
+	}
+}
+
+// closeSession 只关闭属于sessionID这一次UDP ASSOCIATE会话的流，用于该会话的
+// TCP控制连接关闭时的清理，不影响同一条规则上其他并发会话的流及其统计数据。
+func (t *connTrackTable) closeSession(sessionID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, f := range t.flows {
+		if f.sessionID == sessionID {
+			f.upstream.Close()
+			delete(t.flows, key)
+		}
+	}
+}
+
+// newUDPAssociateHandle 构造一个替换go-socks5内置实现的ASSOCIATE处理函数：在内置
+// 行为（绑定本地UDP端口、转发数据报、阻塞读取控制连接以感知客户端断开）的基础上，
+// 增加了按{sessionID, clientAddr, dstAddr}跟踪的NAT会话表、可配置的空闲超时、以及
+// 通过现有TrafficCounter对UDP流量计数。table由同一条规则下的所有并发ASSOCIATE会话
+// 共享，因此用bindLn自己的地址作为sessionID，控制连接关闭时只清理这一个会话的流，
+// 不会影响该规则上其他客户端的会话。
+func (a *App) newUDPAssociateHandle(ruleID string, counter *TrafficCounter, table *connTrackTable) socks5.Handler {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		tcpAddr, ok := request.LocalAddr.(*net.TCPAddr)
+		if !ok {
+			socks5.SendReply(writer, statute.RepServerFailure, nil) //nolint:errcheck
+			return fmt.Errorf("UDP ASSOCIATE: 本地地址不是TCP: %T", request.LocalAddr)
+		}
+
+		bindLn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: 0})
+		if err != nil {
+			socks5.SendReply(writer, statute.RepServerFailure, nil) //nolint:errcheck
+			return fmt.Errorf("UDP ASSOCIATE: 监听失败: %v", err)
+		}
+		defer bindLn.Close()
+
+		if err := socks5.SendReply(writer, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
+			return fmt.Errorf("UDP ASSOCIATE: 发送回复失败: %v", err)
+		}
+
+		// bindLn的本地地址（含临时分配的端口）在其生命周期内唯一，直接拿来做这次
+		// ASSOCIATE会话的sessionID，不需要额外的计数器或随机数生成器
+		sessionID := bindLn.LocalAddr().String()
+
+		fmt.Printf("规则 %s 建立UDP ASSOCIATE会话，中继地址: %s\n", ruleID, bindLn.LocalAddr())
+
+		// 从客户端读取数据报，按{clientAddr, dstAddr}解析/转发到各自的上游套接字
+		go a.udpClientReadLoop(sessionID, bindLn, request, counter, table)
+
+		// 阻塞读取控制连接，客户端断开（EOF）或连接被关闭时结束整个ASSOCIATE会话，
+		// 并只清理这次会话（而非整条规则）名下的UDP流
+		buf := make([]byte, 1)
+		for {
+			if _, err := request.Reader.Read(buf); err != nil {
+				bindLn.Close()
+				table.closeSession(sessionID)
+				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+// udpClientReadLoop 从客户端UDP套接字读取SOCKS5 UDP请求报文，剥离RSV+FRAG+ATYP+
+// DST.ADDR+DST.PORT头部后转发给对应的上游连接；每个{sessionID, clientAddr, dstAddr}
+// 三元组只建立一次上游连接并复用，由udpUpstreamReadLoop负责把回包转发回客户端。
+func (a *App) udpClientReadLoop(sessionID string, bindLn *net.UDPConn, request *socks5.Request, counter *TrafficCounter, table *connTrackTable) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := bindLn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		pkt, err := statute.ParseDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		key := udpFlowKey(sessionID, clientAddr.String(), pkt.DstAddr.String())
+		flow, ok := table.get(key)
+		if !ok {
+			upstream, err := net.Dial("udp", pkt.DstAddr.String())
+			if err != nil {
+				fmt.Printf("UDP ASSOCIATE连接上游 %s 失败: %v\n", pkt.DstAddr.String(), err)
+				continue
+			}
+
+			flow = &udpFlow{
+				sessionID:    sessionID,
+				upstream:     upstream.(*net.UDPConn),
+				clientAddr:   clientAddr,
+				dstAddr:      pkt.DstAddr,
+				createdAt:    time.Now(),
+				lastActiveAt: time.Now(),
+			}
+			table.put(key, flow)
+
+			go a.udpUpstreamReadLoop(bindLn, clientAddr, pkt, flow, counter, table, key)
+		}
+
+		flow.mu.Lock()
+		flow.lastActiveAt = time.Now()
+		flow.uploadBytes += int64(len(pkt.Data))
+		flow.mu.Unlock()
+		flow.upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout)) //nolint:errcheck
+
+		counter.CountUpload(len(pkt.Data))
+
+		if _, err := flow.upstream.Write(pkt.Data); err != nil {
+			fmt.Printf("UDP ASSOCIATE写入上游 %s 失败: %v\n", pkt.DstAddr.String(), err)
+		}
+	}
+}
+
+// udpUpstreamReadLoop 把上游的回包重新套上SOCKS5 UDP头部，转发回客户端；
+// 空闲超过udpIdleTimeout（由SetReadDeadline触发）即回收这条流。
+func (a *App) udpUpstreamReadLoop(bindLn *net.UDPConn, clientAddr *net.UDPAddr, pkt statute.Datagram, flow *udpFlow, counter *TrafficCounter, table *connTrackTable, key string) {
+	defer func() {
+		flow.upstream.Close()
+		table.delete(key)
+	}()
+
+	header := pkt.Header()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := flow.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+
+		flow.mu.Lock()
+		flow.lastActiveAt = time.Now()
+		flow.downloadBytes += int64(n)
+		flow.mu.Unlock()
+		flow.upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout)) //nolint:errcheck
+
+		counter.CountDownload(n)
+
+		reply := append(append([]byte{}, header...), buf[:n]...)
+		if _, err := bindLn.WriteTo(reply, clientAddr); err != nil {
+			fmt.Printf("UDP ASSOCIATE回写客户端 %s 失败: %v\n", clientAddr, err)
+			return
+		}
+	}
+}
+
+// GetUDPSessions returns the currently active UDP ASSOCIATE flows for the
+// given rule, so the frontend can show live NAT sessions.
+func (a *App) GetUDPSessions(id string) ([]UDPSession, error) {
+	a.mu.Lock()
+	table, ok := a.udpTables[id]
+	a.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("规则 %s 没有活跃的UDP会话表", id)
+	}
+
+	return table.snapshot(), nil
+}
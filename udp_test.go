@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// TestDatagramHeaderRoundTrip验证udpClientReadLoop/udpUpstreamReadLoop依赖的
+// statute.Datagram编解码：剥离出的DstAddr/Data与重新拼装的Header()+Data能够
+// 还原出完全一致的数据报，这是NAT表按{sessionID, clientAddr, dstAddr}正确
+// 转发回包的前提。
+func TestDatagramHeaderRoundTrip(t *testing.T) {
+	cases := []struct {
+		name     string
+		destAddr string
+		data     []byte
+	}{
+		{name: "ipv4目标", destAddr: "192.0.2.1:443", data: []byte("hello")},
+		{name: "ipv6目标", destAddr: "[2001:db8::1]:53", data: []byte{0x01, 0x02, 0x03}},
+		{name: "域名目标", destAddr: "example.com:80", data: []byte("GET / HTTP/1.0\r\n\r\n")},
+		{name: "空数据", destAddr: "192.0.2.1:1234", data: nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt, err := statute.NewDatagram(tc.destAddr, tc.data)
+			if err != nil {
+				t.Fatalf("构造Datagram失败: %v", err)
+			}
+
+			wire := pkt.Bytes()
+
+			parsed, err := statute.ParseDatagram(wire)
+			if err != nil {
+				t.Fatalf("解析Datagram失败: %v", err)
+			}
+
+			if parsed.DstAddr.String() != pkt.DstAddr.String() {
+				t.Errorf("DstAddr = %v, 期望 %v", parsed.DstAddr.String(), pkt.DstAddr.String())
+			}
+			if !bytes.Equal(parsed.Data, tc.data) {
+				t.Errorf("Data = %v, 期望 %v", parsed.Data, tc.data)
+			}
+
+			// udpUpstreamReadLoop把上游回包重新套上pkt.Header()再转发给客户端，
+			// 这里验证Header()+回包数据拼出来的报文依然能被正确解析。
+			reassembled := append(append([]byte{}, parsed.Header()...), []byte("reply-data")...)
+			final, err := statute.ParseDatagram(reassembled)
+			if err != nil {
+				t.Fatalf("解析重新拼装的Datagram失败: %v", err)
+			}
+			if string(final.Data) != "reply-data" {
+				t.Errorf("重新拼装的Data = %q, 期望 %q", final.Data, "reply-data")
+			}
+			if final.DstAddr.String() != pkt.DstAddr.String() {
+				t.Errorf("重新拼装的DstAddr = %v, 期望 %v", final.DstAddr.String(), pkt.DstAddr.String())
+			}
+		})
+	}
+}